@@ -2,16 +2,167 @@ package test
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/terraform"
 )
 
-// TestCheckTypeSetElemNestedAttrs is a resource.TestCheckFunc that accepts a resource
-// name, an attribute name and depth which targets a TypeSet, as well as a value
-// map to verify. The function verifies that the TypeSet attribute exists, and that
-// an element matches all the values in the map.
+// primaryInstanceState returns the primary instance state for the given
+// resource name, or an error if the resource or its primary instance cannot
+// be found in state.
+func primaryInstanceState(s *terraform.State, name string) (*terraform.InstanceState, error) {
+	ms := s.RootModule()
+	rs, ok := ms.Resources[name]
+	if !ok {
+		return nil, fmt.Errorf("Not found: %s in %s", name, ms.Path)
+	}
+
+	is := rs.Primary
+	if is == nil {
+		return nil, fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+	}
+
+	return is, nil
+}
+
+// typeSetElemKeyParts splits a TestCheckTypeSetElem* key into its dot
+// separated parts, validating that it ends with the "*" sentinel that
+// identifies the TypeSet element itself. The sentinel stands in for the
+// (non-deterministic) Set/List index Terraform assigns to the element, so
+// that callers do not need to know or depend on it. It may appear more than
+// once in a key to reach into a TypeSet nested inside another TypeSet, e.g.
+// "rule.*.action.*".
+func typeSetElemKeyParts(key string) ([]string, error) {
+	parts := strings.Split(key, ".")
+	if parts[len(parts)-1] != "*" {
+		return nil, fmt.Errorf("key %q must end with the \"*\" sentinel", key)
+	}
+
+	return parts, nil
+}
+
+// typeSetElemKeyMatch reports whether the first len(keyParts) segments of
+// stateKeyParts match keyParts, treating "*" in keyParts as a wildcard that
+// matches any single segment of stateKeyParts.
+func typeSetElemKeyMatch(stateKeyParts, keyParts []string) bool {
+	if len(stateKeyParts) < len(keyParts) {
+		return false
+	}
+
+	for i, part := range keyParts {
+		if part == "*" {
+			continue
+		}
+		if stateKeyParts[i] != part {
+			return false
+		}
+	}
+
+	return true
+}
+
+// typeSetElemKeyForDepth synthesizes a "*"-sentinel key from the legacy
+// attrName/depth pair, wildcarding the depth-1 flatmap segments (attribute
+// names and Set/List indices alike) that precede attrName. This lets the legacy depth-based TestCheckTypeSetElem* signatures
+// keep compiling while delegating to the key-based FindTypeSetElement.
+func typeSetElemKeyForDepth(attrName string, depth int) string {
+	if depth < 1 {
+		depth = 1
+	}
+
+	return strings.Repeat("*.", depth-1) + attrName + ".*"
+}
+
+// FindTypeSetElement locates the element of the TypeSet attribute addressed
+// by key (using "*" as a sentinel in place of its Set/List index, e.g.
+// "rule.*" or, to reach a TypeSet nested inside another TypeSet,
+// "rule.*.action.*") whose nested attributes satisfy matcher, and returns
+// its element ID - the flatmap address of the element itself,
+// suitable for passing to TypeSetElementAttrs. For a TypeSet of simple
+// values rather than nested objects, the element's value is passed to
+// matcher under the empty string key.
+//
+// This is the shared flatmap-walking primitive behind the
+// TestCheckTypeSetElem* and TestMatchTypeSetElem* functions in this package.
+// Use it directly when an assertion needs to be made in more than one step,
+// e.g. finding the rule whose port is 443 and then asserting something about
+// its security_groups sub-set.
+func FindTypeSetElement(s *terraform.State, resourceName, key string, matcher func(elementAttrs map[string]string) bool) (elementID string, err error) {
+	is, err := primaryInstanceState(s, resourceName)
+	if err != nil {
+		return "", err
+	}
+
+	keyParts, err := typeSetElemKeyParts(key)
+	if err != nil {
+		return "", err
+	}
+
+	elements := make(map[string]map[string]string)
+
+	for stateKey, stateValue := range is.Attributes {
+		parts := strings.Split(stateKey, ".")
+		if len(parts) < len(keyParts) || !typeSetElemKeyMatch(parts, keyParts) {
+			continue
+		}
+
+		// the Set/List count entry (e.g. "rule.#") is not an element
+		if parts[len(keyParts)-1] == "#" {
+			continue
+		}
+
+		// ensure the element's container is a Set/List
+		if _, exists := is.Attributes[strings.Join(parts[:len(keyParts)-1], ".")+".#"]; !exists {
+			return "", fmt.Errorf("%q key %q is not a TypeSet", resourceName, key)
+		}
+
+		id := strings.Join(parts[:len(keyParts)], ".")
+		if elements[id] == nil {
+			elements[id] = make(map[string]string)
+		}
+		elements[id][strings.Join(parts[len(keyParts):], ".")] = stateValue
+	}
+
+	for id, attrs := range elements {
+		if matcher(attrs) {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("No TypeSet element in %q with key %q matched, in state: %#v", resourceName, key, is.Attributes)
+}
+
+// TypeSetElementAttrs returns the attributes of the TypeSet element
+// previously located with FindTypeSetElement, keyed relative to the element
+// itself - the same way as the elementAttrs matcher passed to
+// FindTypeSetElement.
+func TypeSetElementAttrs(s *terraform.State, resourceName, elementID string) map[string]string {
+	is, err := primaryInstanceState(s, resourceName)
+	if err != nil {
+		return nil
+	}
+
+	prefix := elementID + "."
+	attrs := make(map[string]string)
+	for stateKey, stateValue := range is.Attributes {
+		if stateKey == elementID {
+			attrs[""] = stateValue
+			continue
+		}
+		if strings.HasPrefix(stateKey, prefix) {
+			attrs[strings.TrimPrefix(stateKey, prefix)] = stateValue
+		}
+	}
+
+	return attrs
+}
+
+// TestCheckTypeSetElemNestedAttrs is a resource.TestCheckFunc that accepts a
+// resource name, an attribute name and depth which targets a TypeSet, as
+// well as a value map to verify. The function verifies that the TypeSet
+// attribute exists, and that an element matches all the values in the map.
 //
 // Use this function over SDK provided TestCheckFunctions when validating a
 // TypeSet where its elements are a nested object with their own attrs/values.
@@ -21,91 +172,174 @@ import (
 // Provide a full mapping of attributes to be sure the unique element exists.
 func TestCheckTypeSetElemNestedAttrs(resourceName, attrName string, depth int, values map[string]string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		ms := s.RootModule()
-		rs, ok := ms.Resources[resourceName]
-		if !ok {
-			return fmt.Errorf("Not found: %s in %s", resourceName, ms.Path)
-		}
-
-		is := rs.Primary
-		if is == nil {
-			return fmt.Errorf("No primary instance: %s in %s", resourceName, ms.Path)
-		}
-
-		matches := make(map[string]int)
-
-		for stateKey, stateValue := range is.Attributes {
-			parts := strings.Split(stateKey, ".")
-			// a Set/List item with nested attrs would have a flatmap address of
-			// at least length 3
-			// foo.0.name = "bar"
-			d := len(parts) - 3
-			if d < 0 {
-				continue
-			}
-			attr := parts[d]
-			if attr == attrName && d == depth-1 {
-				// ensure this is a Set/List
-				if _, exists := is.Attributes[strings.Join(parts[:d+1], ".")+".#"]; !exists {
-					return fmt.Errorf("%q attr %q is not TypeSet", resourceName, attrName)
-				}
-				elementId := parts[d+1]
-				nestedAttr := strings.Join(parts[d+2:], ".")
-				// check if the nestedAttr exists in the passed values map
-				// if it does, and matches, increment the matches count
-				if v, exists := values[nestedAttr]; exists && stateValue == v {
-					matches[elementId] = matches[elementId] + 1
-					// exit if there is an element that is a full match
-					if matches[elementId] == len(values) {
-						return nil
-					}
+		_, err := FindTypeSetElement(s, resourceName, typeSetElemKeyForDepth(attrName, depth), func(attrs map[string]string) bool {
+			for nestedAttr, value := range values {
+				if v, exists := attrs[nestedAttr]; !exists || v != value {
+					return false
 				}
 			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("%s, with nested attrs %#v", err, values)
 		}
 
-		return fmt.Errorf("No TypeSet element in %q with attr name %q at depth %d, with nested attrs %#v in state: %#v", resourceName, attrName, depth, values, is.Attributes)
+		return nil
 	}
 }
 
-// TestCheckTypeSetElemAttr is a resource.TestCheckFunc that accepts a resource
-// name, an attribute name and depth which targets a TypeSet, as well as a value
-// to verify. The function verifies that the TypeSet attribute exists, and that
-// an element matches the passed value.
+// TestCheckTypeSetElemAttr is a resource.TestCheckFunc that accepts a
+// resource name, an attribute name and depth which targets a TypeSet, as
+// well as a value to verify. The function verifies that the TypeSet
+// attribute exists, and that an element matches the passed value.
 //
 // Use this function over SDK provided TestCheckFunctions when validating a
 // TypeSet where its elements are a simple value
 func TestCheckTypeSetElemAttr(resourceName, attrName string, depth int, value string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		ms := s.RootModule()
-		rs, ok := ms.Resources[resourceName]
+		_, err := FindTypeSetElement(s, resourceName, typeSetElemKeyForDepth(attrName, depth), func(attrs map[string]string) bool {
+			return attrs[""] == value
+		})
+		if err != nil {
+			return fmt.Errorf("%s, with value %q", err, value)
+		}
+
+		return nil
+	}
+}
+
+// TestCheckTypeSetElemAttrPair is a resource.TestCheckFunc that asserts that
+// the value of a scalar attribute on a second resource (e.g. the id of
+// aws_security_group.foo) appears as one of the elements of a TypeSet
+// attribute on a first resource (e.g.
+// aws_instance.bar.vpc_security_group_ids). keyFirst addresses the TypeSet
+// element using "*" as a sentinel in place of its Set/List index, e.g.
+// "vpc_security_group_ids.*"; keySecond is a plain attribute key on the
+// second resource.
+//
+// Use this function over resource.TestCheckResourceAttrPair when the value
+// being compared lives at a non-deterministic index of a TypeSet, such as
+// when an AWS resource references an ID generated by another resource into
+// an unordered set (security group IDs, subnet IDs, target group ARNs, etc.).
+func TestCheckTypeSetElemAttrPair(nameFirst, keyFirst, nameSecond, keySecond string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		isSecond, err := primaryInstanceState(s, nameSecond)
+		if err != nil {
+			return err
+		}
+
+		vSecond, ok := isSecond.Attributes[keySecond]
 		if !ok {
-			return fmt.Errorf("Not found: %s in %s", resourceName, ms.Path)
+			return fmt.Errorf("%q key %q not found in state", nameSecond, keySecond)
 		}
 
-		is := rs.Primary
-		if is == nil {
-			return fmt.Errorf("No primary instance: %s in %s", resourceName, ms.Path)
+		var elements []string
+		_, err = FindTypeSetElement(s, nameFirst, keyFirst, func(attrs map[string]string) bool {
+			elements = append(elements, attrs[""])
+			return attrs[""] == vSecond
+		})
+		if err != nil {
+			return fmt.Errorf("%s, matching %q key %q (%q), observed elements: %#v", err, nameSecond, keySecond, vSecond, elements)
+		}
+
+		return nil
+	}
+}
+
+// TestCheckTypeSetElemAttrWith is a resource.TestCheckFunc that accepts a
+// resource name and a key identifying a TypeSet attribute, using "*" as a
+// sentinel in place of its Set/List index, along with a check function. The
+// function verifies that the TypeSet attribute exists, and that check
+// returns nil for at least one element's value.
+//
+// Use this function over TestCheckTypeSetElemAttr when the exact value of
+// the TypeSet element cannot be known ahead of time, e.g. a generated ARN or
+// a timestamp embedded in a tag.
+func TestCheckTypeSetElemAttrWith(resourceName, key string, check func(value string) error) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := FindTypeSetElement(s, resourceName, key, func(attrs map[string]string) bool {
+			return check(attrs[""]) == nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s, satisfying the check function", err)
 		}
 
-		for stateKey, stateValue := range is.Attributes {
-			parts := strings.Split(stateKey, ".")
-			// a Set/List item would have a flatmap address of at least length 2
-			// foo.0 = "bar"
-			d := len(parts) - 2
-			if d < 0 {
-				continue
+		return nil
+	}
+}
+
+// TestCheckTypeSetElemNestedAttrsWith is a resource.TestCheckFunc that
+// accepts a resource name and a key identifying a TypeSet attribute, using
+// "*" as a sentinel in place of its Set/List index, along with a map of
+// nested attribute names to check functions. The function verifies that the
+// TypeSet attribute exists, and that a single element satisfies every check
+// in the map.
+//
+// Use this function over TestCheckTypeSetElemNestedAttrs when the exact
+// value of one or more of the element's nested attributes cannot be known
+// ahead of time.
+func TestCheckTypeSetElemNestedAttrsWith(resourceName, key string, checks map[string]func(value string) error) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := FindTypeSetElement(s, resourceName, key, func(attrs map[string]string) bool {
+			for nestedAttr, check := range checks {
+				v, exists := attrs[nestedAttr]
+				if !exists || check(v) != nil {
+					return false
+				}
 			}
-			attr := parts[d]
-			if attr == attrName && d == depth-1 && stateValue == value {
-				// ensure this is a Set/List
-				if _, exists := is.Attributes[strings.Join(parts[:d+1], ".")+".#"]; !exists {
-					return fmt.Errorf("%q attr %q is not TypeSet", resourceName, attrName)
-				} else {
-					return nil
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("%s, satisfying the check functions", err)
+		}
+
+		return nil
+	}
+}
+
+// TestMatchTypeSetElemAttr is a resource.TestCheckFunc that accepts a
+// resource name and a key identifying a TypeSet attribute, using "*" as a
+// sentinel in place of its Set/List index, along with a regular expression.
+// The function verifies that the TypeSet attribute exists, and that at
+// least one element's value matches the regular expression.
+//
+// Many AWS-generated identifiers embedded in sets - ARNs, resource IDs,
+// auto-generated names - are only knowable by shape. Use this function over
+// TestCheckTypeSetElemAttr in those cases.
+func TestMatchTypeSetElemAttr(resourceName, key string, r *regexp.Regexp) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := FindTypeSetElement(s, resourceName, key, func(attrs map[string]string) bool {
+			return r.MatchString(attrs[""])
+		})
+		if err != nil {
+			return fmt.Errorf("%s, with a value matching %q", err, r.String())
+		}
+
+		return nil
+	}
+}
+
+// TestMatchTypeSetElemNestedAttrs is a resource.TestCheckFunc that accepts a
+// resource name and a key identifying a TypeSet attribute, using "*" as a
+// sentinel in place of its Set/List index, along with a map of nested
+// attribute names to regular expressions. The function verifies that the
+// TypeSet attribute exists, and that a single element's nested attributes
+// each match their corresponding regular expression.
+func TestMatchTypeSetElemNestedAttrs(resourceName, key string, values map[string]*regexp.Regexp) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := FindTypeSetElement(s, resourceName, key, func(attrs map[string]string) bool {
+			for nestedAttr, r := range values {
+				v, exists := attrs[nestedAttr]
+				if !exists || !r.MatchString(v) {
+					return false
 				}
 			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("%s, with nested attrs matching %#v", err, values)
 		}
 
-		return fmt.Errorf("No TypeSet element in %q with attr name %q at depth %d, with value %q in state: %#v", resourceName, attrName, depth, value, is.Attributes)
+		return nil
 	}
 }